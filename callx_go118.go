@@ -0,0 +1,29 @@
+//go:build windows && go1.18
+
+package tempdll
+
+import "syscall"
+
+// callAddr invokes the function at addr with arguments a, using
+// syscall.SyscallN so there is no fixed limit on argument count. It
+// underlies both CallN and memory-loaded LazyProc.Call, which have no
+// *syscall.Proc to delegate to.
+//
+//go:uintptrescapes
+func callAddr(addr uintptr, a ...uintptr) (r1, r2 uintptr, lastErr error) {
+	r1, r2, errno := syscall.SyscallN(addr, a...)
+	if errno != 0 {
+		lastErr = errno
+	}
+	return r1, r2, lastErr
+}
+
+// CallN executes procedure p with arguments a. It calls p's address
+// directly through syscall.SyscallN rather than through syscall.Proc.Call,
+// so it is not limited to 15 arguments, and callers driving modern Win32
+// APIs with large argument lists (COM vtables, DirectX, the Vulkan loader)
+// are not silently truncated the way syscall.Proc.Call historically was.
+func (p *LazyProc) CallN(a ...uintptr) (r1, r2 uintptr, lastErr error) {
+	p.mustFind()
+	return callAddr(p.addr(), a...)
+}
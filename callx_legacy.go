@@ -0,0 +1,51 @@
+//go:build windows && !go1.18
+
+package tempdll
+
+import (
+	"syscall"
+)
+
+// callAddr invokes the function at addr with arguments a, up to 18 of them.
+// It exists for Go versions before 1.18, which did not yet have
+// syscall.SyscallN: it rounds the argument count up to the nearest of
+// syscall.Syscall's fixed arities (3, 6, 9, 12, 15, 18), padding the rest
+// with zero, the same way syscall.Proc.Call did internally. It underlies
+// both CallN and memory-loaded LazyProc.Call, which have no *syscall.Proc to
+// delegate to.
+//
+//go:uintptrescapes
+func callAddr(addr uintptr, a ...uintptr) (r1, r2 uintptr, lastErr error) {
+	var args [18]uintptr
+	if len(a) > len(args) {
+		panic("tempdll: too many arguments to CallN (max 18)")
+	}
+	copy(args[:], a)
+
+	var errno syscall.Errno
+	switch {
+	case len(a) <= 3:
+		r1, r2, errno = syscall.Syscall(addr, uintptr(len(a)), args[0], args[1], args[2])
+	case len(a) <= 6:
+		r1, r2, errno = syscall.Syscall6(addr, uintptr(len(a)), args[0], args[1], args[2], args[3], args[4], args[5])
+	case len(a) <= 9:
+		r1, r2, errno = syscall.Syscall9(addr, uintptr(len(a)), args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8])
+	case len(a) <= 12:
+		r1, r2, errno = syscall.Syscall12(addr, uintptr(len(a)), args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10], args[11])
+	case len(a) <= 15:
+		r1, r2, errno = syscall.Syscall15(addr, uintptr(len(a)), args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10], args[11], args[12], args[13], args[14])
+	default:
+		r1, r2, errno = syscall.Syscall18(addr, uintptr(len(a)), args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7], args[8], args[9], args[10], args[11], args[12], args[13], args[14], args[15], args[16], args[17])
+	}
+	if errno != 0 {
+		lastErr = errno
+	}
+	return r1, r2, lastErr
+}
+
+// CallN executes procedure p with arguments a, up to 18 of them. It exists
+// for Go versions before 1.18, which did not yet have syscall.SyscallN.
+func (p *LazyProc) CallN(a ...uintptr) (r1, r2 uintptr, lastErr error) {
+	p.mustFind()
+	return callAddr(p.addr(), a...)
+}
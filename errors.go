@@ -0,0 +1,32 @@
+package tempdll
+
+import "errors"
+
+// ErrContentMismatch is the sentinel wrapped by DLLError when the temp file
+// on disk still didn't match the expected contents after every retry in
+// safeWriteFile, e.g. because another process (commonly an antivirus
+// scanner) is rewriting it concurrently.
+var ErrContentMismatch = errors.New("tempdll: file contents did not match after retries")
+
+// DLLError describes a failure preparing or loading a temp DLL/shared
+// library. It mirrors the shape of syscall.DLLError (Err, ObjName, Msg,
+// Unwrap) so callers already using errors.As against that type can adopt
+// this one the same way.
+//
+// ReadErr and WriteErr preserve both sides of a safeWriteFile retry
+// failure. Wrapping both with separate %w verbs in one fmt.Errorf call only
+// leaves the last one unwrappable on Go versions before 1.20, which loses
+// exactly the information (e.g. "AV is holding the file open" vs. "disk is
+// full") a caller would need to decide whether to retry.
+type DLLError struct {
+	Err     error  // the primary cause; what Unwrap returns
+	ObjName string // the DLL/shared-library name involved
+	Msg     string // a human readable description of what went wrong
+
+	ReadErr  error // the last error reading the file back, if any
+	WriteErr error // the last error writing the file, if any
+}
+
+func (e *DLLError) Error() string { return e.Msg }
+
+func (e *DLLError) Unwrap() error { return e.Err }
@@ -2,12 +2,92 @@ package tempdll
 
 import (
 	"bytes"
+	"encoding/base32"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 )
 
+// fileNameSafeEncoder produces filesystem-safe, case-insensitive-safe names
+// for the sha256 hash used to name temp DLL/shared-library files.
+var fileNameSafeEncoder = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// dllFileRef tracks how many LazyDLLs are currently backed by the same
+// on-disk temp file, keyed by its path (the sha256 of the contents plus the
+// LazyDLL's Name). Separate LazyDLL values with identical content and the
+// same Name share one copy on disk; the same content under a different Name
+// gets its own file. A file is only removed once the last reference
+// releases it.
+type dllFileRef struct {
+	count  int
+	handle *os.File
+}
+
+var (
+	dllFileRefsMu sync.Mutex
+	dllFileRefs   = map[string]*dllFileRef{}
+)
+
+// acquireFile returns the *os.File backing fileName, writing contents to
+// disk via safeWriteFile only if this is the first reference to that file.
+// If fileName has already disappeared from disk by the time a later caller
+// reuses an existing reference (the unix LazyDLL unlinks it immediately
+// after a successful dlopen, relying on the open fd/mapping to keep the
+// inode alive), it is rewritten so that caller can still open it by path,
+// and the ref's stored handle is replaced (closing the old one) so the
+// newly opened fd is the one releaseFile eventually closes. Each successful
+// call must be paired with a releaseFile call.
+func acquireFile(fileName string, contents []byte, retryCount int, retryDelay time.Duration) (*os.File, error) {
+	dllFileRefsMu.Lock()
+	defer dllFileRefsMu.Unlock()
+
+	if ref, ok := dllFileRefs[fileName]; ok {
+		if _, err := os.Stat(fileName); err != nil {
+			newHandle, err := safeWriteFile(fileName, contents, retryCount, retryDelay)
+			if err != nil {
+				return nil, err
+			}
+			ref.handle.Close()
+			ref.handle = newHandle
+		}
+		ref.count++
+		return ref.handle, nil
+	}
+
+	handle, err := safeWriteFile(fileName, contents, retryCount, retryDelay)
+	if err != nil {
+		return nil, err
+	}
+	dllFileRefs[fileName] = &dllFileRef{count: 1, handle: handle}
+	return handle, nil
+}
+
+// releaseFile drops a reference acquired by acquireFile. Once the last
+// reference is released, the backing handle is closed and the temp file is
+// removed from disk, if it is still there (the unix LazyDLL typically
+// already unlinked it right after loading).
+func releaseFile(fileName string) error {
+	dllFileRefsMu.Lock()
+	defer dllFileRefsMu.Unlock()
+
+	ref, ok := dllFileRefs[fileName]
+	if !ok {
+		return nil
+	}
+	ref.count--
+	if ref.count > 0 {
+		return nil
+	}
+	delete(dllFileRefs, fileName)
+	ref.handle.Close()
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 type fileHolder struct {
 	handle *os.File
 }
@@ -43,7 +123,12 @@ func safeWriteFile(fileName string, contents []byte, retryCount int, retryDelay
 				return toReturn, nil
 			} else if i == retryCount {
 				// files shouldn't be the same on our last go around
-				return nil, fmt.Errorf("file contents differed last lastWriterError %w", wErr)
+				return nil, &DLLError{
+					Err:      ErrContentMismatch,
+					ObjName:  fileName,
+					Msg:      fmt.Sprintf("tempdll: %s: file contents differed, last writer error: %v", fileName, wErr),
+					WriteErr: wErr,
+				}
 			}
 		}
 
@@ -57,7 +142,13 @@ func safeWriteFile(fileName string, contents []byte, retryCount int, retryDelay
 		if wErr != nil {
 			if i == retryCount {
 				// files shouldn't be the same on our last go around
-				return nil, fmt.Errorf("Error writting file readerError %w, lastWriterError %w", err, wErr)
+				return nil, &DLLError{
+					Err:      wErr,
+					ObjName:  fileName,
+					Msg:      fmt.Sprintf("tempdll: %s: error writing file, reader error: %v, writer error: %v", fileName, err, wErr),
+					ReadErr:  err,
+					WriteErr: wErr,
+				}
 			}
 		}
 
@@ -69,6 +160,12 @@ func safeWriteFile(fileName string, contents []byte, retryCount int, retryDelay
 		}
 	}
 
-	return nil, fmt.Errorf("file contents differed last readerError %w, lastWriterError %w", err, wErr)
+	return nil, &DLLError{
+		Err:      ErrContentMismatch,
+		ObjName:  fileName,
+		Msg:      fmt.Sprintf("tempdll: %s: file contents differed, reader error: %v, writer error: %v", fileName, err, wErr),
+		ReadErr:  err,
+		WriteErr: wErr,
+	}
 
 }
@@ -1,9 +1,11 @@
+//go:build windows
+
 package tempdll
 
 import (
 	"bytes"
 	"crypto/sha256"
-	"encoding/base32"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -25,10 +27,34 @@ type LazyDLL struct {
 	dll  *syscall.DLL // non nil once DLL is loaded
 	Name string
 
+	// System, when true, causes Load to behave as if Flags had
+	// LOAD_LIBRARY_SEARCH_SYSTEM32 set, matching the System field on
+	// golang.org/x/sys/windows.LazyDLL. It is equivalent to setting that
+	// flag directly in Flags and is provided for source compatibility.
+	System bool
+
+	// Flags is passed to LoadLibraryEx when non-zero, e.g.
+	// LOAD_WITH_ALTERED_SEARCH_PATH, LOAD_LIBRARY_SEARCH_SYSTEM32, or
+	// LOAD_LIBRARY_AS_DATAFILE. When both Flags and System are zero, Load
+	// falls back to syscall.LoadDLL.
+	Flags uint32
+
 	wroteDll  bool
 	dllHandle *os.File // a readonly fileHandle to block writes
 	fileName  string   // the full path to the dll that is created
 	dllData   io.Reader
+	dllBytes  []byte // contents of dllData, read once and reused across Release/Load cycles
+
+	// generation is bumped by Release so that LazyProcs resolved before it
+	// know to re-resolve against the reloaded module instead of reusing a
+	// now-freed/unmapped address.
+	generation uint32
+
+	// memory and mem back NewMemoryLazyDLL: when memory is true, Load maps
+	// and relocates the PE image in process memory instead of writing it to
+	// a temp file, and mem holds the resulting in-memory module.
+	memory bool
+	mem    *peImage
 }
 
 func copyFile(dst string, data io.Reader) error {
@@ -70,11 +96,12 @@ func OpenWithDelete(fileName string) *syscall.Handle {
 	return handle
 }
 
-var fileNameSafeEncoder = base32.StdEncoding.WithPadding(base32.NoPadding)
-
 // Load loads DLL file d.Name into memory. It returns an error if fails.
 // Load will not try to load DLL, if it is already loaded into memory.
 func (d *LazyDLL) Load() error {
+	if d.memory {
+		return d.loadMemory()
+	}
 	// Non-racy version of:
 	// if d.dll == nil {
 	if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&d.dll))) == nil {
@@ -82,27 +109,45 @@ func (d *LazyDLL) Load() error {
 		defer d.mu.Unlock()
 		if d.dll == nil {
 			if !d.wroteDll {
-
-				contents := bytes.NewBuffer(nil)
-				_, e := io.Copy(contents, d.dllData)
-				if e != nil {
-					return e
+				if d.dllBytes == nil {
+					contents := bytes.NewBuffer(nil)
+					if _, e := io.Copy(contents, d.dllData); e != nil {
+						return e
+					}
+					d.dllBytes = contents.Bytes()
 				}
 
-				sha := sha256.Sum256(contents.Bytes())
+				sha := sha256.Sum256(d.dllBytes)
 				shaFileName := fileNameSafeEncoder.EncodeToString(sha[:])
 				d.fileName = filepath.Join(os.TempDir(), (shaFileName + "-" + d.Name))
 
-				d.dllHandle, e = safeWriteFile(d.fileName, contents.Bytes(), 60, time.Second)
+				handle, e := acquireFile(d.fileName, d.dllBytes, 60, time.Second)
 				if e != nil {
 					return e
 				}
+				d.dllHandle = handle
 
 				d.wroteDll = true
 			}
-			dll, e := syscall.LoadDLL(d.fileName)
+
+			flags := d.Flags
+			if d.System {
+				flags |= windows.LOAD_LIBRARY_SEARCH_SYSTEM32
+			}
+
+			var dll *syscall.DLL
+			var e error
+			if flags != 0 {
+				dll, e = loadLibraryEx(d.fileName, flags)
+			} else {
+				dll, e = syscall.LoadDLL(d.fileName)
+			}
 			if e != nil {
-				return e
+				return &DLLError{
+					Err:     e,
+					ObjName: d.Name,
+					Msg:     fmt.Sprintf("tempdll: %s: LoadLibrary failed: %v", d.Name, e),
+				}
 			}
 			// Non-racy version of:
 			// d.dll = dll
@@ -123,14 +168,75 @@ func (d *LazyDLL) mustLoad() {
 // Handle returns d's module handle.
 func (d *LazyDLL) Handle() uintptr {
 	d.mustLoad()
+	if d.memory {
+		return d.mem.base
+	}
 	return uintptr(d.dll.Handle)
 }
 
+// Release unloads d, if loaded, by calling FreeLibrary on its module handle
+// and dropping its reference on the backing temp file. The temp file itself
+// is only deleted once every LazyDLL sharing it (same content and Name) has
+// released it. After Release returns, d may be loaded again with Load,
+// which re-acquires the temp file (from the cached bytes read on the first
+// Load, not by re-reading dllData) and calls LoadLibrary again; LazyProcs
+// resolved before the Release re-resolve themselves against the reloaded
+// module instead of reusing their now-invalid address.
+//
+// For a LazyDLL created with NewMemoryLazyDLL, Release instead runs
+// DLL_PROCESS_DETACH and frees the in-memory image.
+func (d *LazyDLL) Release() error {
+	if d.memory {
+		return d.releaseMemory()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dll == nil {
+		return nil
+	}
+
+	freeErr := syscall.FreeLibrary(d.dll.Handle)
+	releaseErr := releaseFile(d.fileName)
+
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&d.dll)), nil)
+	d.dllHandle = nil
+	d.wroteDll = false
+	atomic.AddUint32(&d.generation, 1)
+
+	if freeErr != nil {
+		return freeErr
+	}
+	return releaseErr
+}
+
 // NewLazyDLL creates new LazyDLL associated with DLL file.
 func NewLazyDLL(dll io.Reader, name string) *LazyDLL {
 	return &LazyDLL{Name: name, dllData: dll}
 }
 
+// NewLazyDLLEx creates a new LazyDLL associated with DLL file, loaded via
+// LoadLibraryExW with the given flags (e.g. LOAD_WITH_ALTERED_SEARCH_PATH,
+// LOAD_LIBRARY_SEARCH_SYSTEM32, LOAD_LIBRARY_AS_DATAFILE) instead of
+// syscall.LoadDLL. Passing flags lets callers pin the DLL search path and
+// avoid DLL preloading attacks, or load a resource-only DLL as a datafile.
+// With flags of zero (and System unset), Load uses syscall.LoadDLL, the same
+// as for NewLazyDLL.
+func NewLazyDLLEx(dll io.Reader, name string, flags uint32) *LazyDLL {
+	return &LazyDLL{Name: name, dllData: dll, Flags: flags}
+}
+
+// loadLibraryEx loads fileName via LoadLibraryExW with flags and wraps the
+// resulting handle in a *syscall.DLL so it can be used with syscall.Proc.
+func loadLibraryEx(fileName string, flags uint32) (*syscall.DLL, error) {
+	handle, e := windows.LoadLibraryEx(fileName, 0, uintptr(flags))
+	if e != nil {
+		return nil, e
+	}
+	return &syscall.DLL{Name: fileName, Handle: syscall.Handle(handle)}, nil
+}
+
 // A LazyProc implements access to a procedure inside a LazyDLL.
 // It delays the lookup until the Addr, Call, or Find method is called.
 type LazyProc struct {
@@ -138,6 +244,10 @@ type LazyProc struct {
 	Name string
 	l    *LazyDLL
 	proc *syscall.Proc
+
+	memAddr uintptr // resolved address when l was created with NewMemoryLazyDLL
+
+	gen uint32 // the l.generation this resolution was made against
 }
 
 // NewProc returns a LazyProc for accessing the named procedure in the DLL d.
@@ -147,14 +257,40 @@ func (d *LazyDLL) NewProc(name string) *LazyProc {
 
 // Find searches DLL for procedure named p.Name. It returns
 // an error if search fails. Find will not search procedure,
-// if it is already found and loaded into memory.
+// if it is already found and loaded into memory, unless l has since been
+// Released and reloaded, in which case p re-resolves against the reload.
+//
+// For a LazyProc on a LazyDLL created with NewMemoryLazyDLL, Find instead
+// walks the loaded image's export directory table.
 func (p *LazyProc) Find() error {
+	if p.l.memory {
+		curGen := atomic.LoadUint32(&p.l.generation)
+		if atomic.LoadUintptr(&p.memAddr) == 0 || atomic.LoadUint32(&p.gen) != curGen {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.memAddr == 0 || p.gen != curGen {
+				e := p.l.Load()
+				if e != nil {
+					return e
+				}
+				addr, e := p.l.mem.findExport(p.Name)
+				if e != nil {
+					return e
+				}
+				atomic.StoreUintptr(&p.memAddr, addr)
+				atomic.StoreUint32(&p.gen, curGen)
+			}
+		}
+		return nil
+	}
+
 	// Non-racy version of:
 	// if p.proc == nil {
-	if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&p.proc))) == nil {
+	curGen := atomic.LoadUint32(&p.l.generation)
+	if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&p.proc))) == nil || atomic.LoadUint32(&p.gen) != curGen {
 		p.mu.Lock()
 		defer p.mu.Unlock()
-		if p.proc == nil {
+		if p.proc == nil || p.gen != curGen {
 			e := p.l.Load()
 			if e != nil {
 				return e
@@ -166,6 +302,7 @@ func (p *LazyProc) Find() error {
 			// Non-racy version of:
 			// p.proc = proc
 			atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&p.proc)), unsafe.Pointer(proc))
+			atomic.StoreUint32(&p.gen, curGen)
 		}
 	}
 	return nil
@@ -179,11 +316,20 @@ func (p *LazyProc) mustFind() {
 	}
 }
 
+// addr returns the resolved address of p, whichever of the two loading
+// strategies produced it.
+func (p *LazyProc) addr() uintptr {
+	if p.l.memory {
+		return p.memAddr
+	}
+	return p.proc.Addr()
+}
+
 // Addr returns the address of the procedure represented by p.
 // The return value can be passed to Syscall to run the procedure.
 func (p *LazyProc) Addr() uintptr {
 	p.mustFind()
-	return p.proc.Addr()
+	return p.addr()
 }
 
 //go:uintptrescapes
@@ -192,5 +338,8 @@ func (p *LazyProc) Addr() uintptr {
 // Proc.Call for more information.
 func (p *LazyProc) Call(a ...uintptr) (r1, r2 uintptr, lastErr error) {
 	p.mustFind()
+	if p.l.memory {
+		return callAddr(p.memAddr, a...)
+	}
 	return p.proc.Call(a...)
 }
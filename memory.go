@@ -0,0 +1,556 @@
+//go:build windows
+
+package tempdll
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// peImage describes a DLL that NewMemoryLazyDLL mapped and relocated
+// directly in process memory, bypassing the temp-file/LoadLibrary path
+// entirely.
+type peImage struct {
+	base          uintptr
+	size          uintptr
+	image         []byte // a []byte view over [base, base+size), for export lookups
+	entryPointRVA uint32
+	exportRVA     uint32
+	exportSize    uint32
+}
+
+// PE/COFF data directory indices, see the Microsoft PE format spec.
+const (
+	imageDirectoryEntryExport    = 0
+	imageDirectoryEntryImport    = 1
+	imageDirectoryEntryBaseReloc = 5
+	imageDirectoryEntryTLS       = 9
+)
+
+const imageFileDLL = 0x2000 // IMAGE_FILE_DLL characteristic bit
+
+const (
+	dllProcessAttach = 1
+	dllProcessDetach = 0
+)
+
+const (
+	imageRelBasedAbsolute = 0
+	imageRelBasedHighLow  = 3
+	imageRelBasedDir64    = 10
+)
+
+const (
+	imageOrdinalFlag32 = uint64(1) << 31
+	imageOrdinalFlag64 = uint64(1) << 63
+)
+
+type imageExportDirectory struct {
+	Characteristics       uint32
+	TimeDateStamp         uint32
+	MajorVersion          uint16
+	MinorVersion          uint16
+	Name                  uint32
+	Base                  uint32
+	NumberOfFunctions     uint32
+	NumberOfNames         uint32
+	AddressOfFunctions    uint32
+	AddressOfNames        uint32
+	AddressOfNameOrdinals uint32
+}
+
+// kernel32GetProcAddress is used to resolve imports by ordinal, which
+// windows.GetProcAddress cannot do since it always marshals its procname
+// argument as a string.
+var kernel32GetProcAddress = windows.NewLazySystemDLL("kernel32.dll").NewProc("GetProcAddress")
+
+// NewMemoryLazyDLL creates a LazyDLL that, on Load, maps and relocates the
+// PE image from dll directly into this process's memory instead of writing
+// it to a temp file and calling LoadLibrary. Find/Addr resolve symbols by
+// walking the export directory table rather than calling syscall.FindProc.
+// This leaves no trace on disk, at the cost of reimplementing the loader:
+// only images matching the host architecture are supported. On Load, TLS
+// callbacks and then DllMain are called with DLL_PROCESS_ATTACH; on Release,
+// only DllMain is called, with DLL_PROCESS_DETACH. TLS callbacks are not
+// called on detach, and thread attach/detach notifications are not sent.
+func NewMemoryLazyDLL(dll io.Reader, name string) *LazyDLL {
+	return &LazyDLL{Name: name, dllData: dll, memory: true}
+}
+
+// loadMemory implements Load for a memory-mapped LazyDLL.
+func (d *LazyDLL) loadMemory() error {
+	if atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&d.mem))) == nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.mem == nil {
+			if d.dllBytes == nil {
+				contents := bytes.NewBuffer(nil)
+				if _, e := io.Copy(contents, d.dllData); e != nil {
+					return e
+				}
+				d.dllBytes = contents.Bytes()
+			}
+
+			mem, e := mapPEImage(d.dllBytes)
+			if e != nil {
+				return &DLLError{Err: e, ObjName: d.Name, Msg: fmt.Sprintf("tempdll: %s: in-memory load failed: %v", d.Name, e)}
+			}
+
+			atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&d.mem)), unsafe.Pointer(mem))
+		}
+	}
+	return nil
+}
+
+// releaseMemory implements Release for a memory-mapped LazyDLL.
+func (d *LazyDLL) releaseMemory() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.mem == nil {
+		return nil
+	}
+
+	if d.mem.entryPointRVA != 0 {
+		callAddr(d.mem.base+uintptr(d.mem.entryPointRVA), d.mem.base, dllProcessDetach, 0)
+	}
+	err := windows.VirtualFree(d.mem.base, 0, windows.MEM_RELEASE)
+
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&d.mem)), nil)
+	atomic.AddUint32(&d.generation, 1)
+	return err
+}
+
+// mapPEImage parses, maps, relocates, and initializes the PE image in data,
+// returning a handle to the now-live in-memory module.
+func mapPEImage(data []byte) (*peImage, error) {
+	f, err := pe.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if f.Characteristics&imageFileDLL == 0 {
+		return nil, fmt.Errorf("tempdll: image is not a DLL (IMAGE_FILE_DLL not set)")
+	}
+
+	layout, err := peLayoutFrom(f)
+	if err != nil {
+		return nil, err
+	}
+	var hostMachine uint16
+	switch runtime.GOARCH {
+	case "386":
+		hostMachine = pe.IMAGE_FILE_MACHINE_I386
+	case "amd64":
+		hostMachine = pe.IMAGE_FILE_MACHINE_AMD64
+	case "arm":
+		hostMachine = pe.IMAGE_FILE_MACHINE_ARMNT
+	case "arm64":
+		hostMachine = pe.IMAGE_FILE_MACHINE_ARM64
+	}
+	if f.Machine != hostMachine || layout.is64 != (unsafe.Sizeof(uintptr(0)) == 8) {
+		return nil, fmt.Errorf("tempdll: image architecture does not match host (GOARCH=%s)", runtime.GOARCH)
+	}
+
+	base, err := windows.VirtualAlloc(0, uintptr(layout.sizeOfImage), windows.MEM_COMMIT|windows.MEM_RESERVE, windows.PAGE_EXECUTE_READWRITE)
+	if err != nil {
+		return nil, err
+	}
+	// base is the start of a MEM_COMMIT|MEM_RESERVE region returned by
+	// VirtualAlloc above, exactly layout.sizeOfImage bytes long, so
+	// reinterpreting it as a []byte of that length here is safe; go vet
+	// cannot see that guarantee and flags the conversion regardless.
+	image := unsafe.Slice((*byte)(unsafe.Pointer(base)), layout.sizeOfImage)
+
+	if int(layout.sizeOfHeaders) <= len(data) {
+		copy(image[:layout.sizeOfHeaders], data[:layout.sizeOfHeaders])
+	}
+	for _, sec := range f.Sections {
+		if sec.Size == 0 || sec.VirtualAddress+sec.Size > layout.sizeOfImage {
+			continue
+		}
+		raw, err := sec.Data()
+		if err != nil {
+			windows.VirtualFree(base, 0, windows.MEM_RELEASE)
+			return nil, err
+		}
+		copy(image[sec.VirtualAddress:sec.VirtualAddress+sec.Size], raw)
+	}
+
+	delta := int64(base) - int64(layout.imageBase)
+	if delta != 0 {
+		if err := applyRelocations(image, layout); err != nil {
+			windows.VirtualFree(base, 0, windows.MEM_RELEASE)
+			return nil, err
+		}
+	}
+
+	if err := resolveImports(image, layout); err != nil {
+		windows.VirtualFree(base, 0, windows.MEM_RELEASE)
+		return nil, err
+	}
+
+	protectSections(base, f, layout)
+
+	runTLSCallbacks(image, base, layout)
+
+	entry := base + uintptr(layout.entryPointRVA)
+	if layout.entryPointRVA != 0 {
+		r1, _, _ := callAddr(entry, base, dllProcessAttach, 0)
+		if r1 == 0 {
+			windows.VirtualFree(base, 0, windows.MEM_RELEASE)
+			return nil, fmt.Errorf("tempdll: DllMain returned FALSE")
+		}
+	}
+
+	mem := &peImage{base: base, size: uintptr(layout.sizeOfImage), image: image, entryPointRVA: layout.entryPointRVA}
+
+	if len(layout.dataDirs) > imageDirectoryEntryExport {
+		dir := layout.dataDirs[imageDirectoryEntryExport]
+		mem.exportRVA, mem.exportSize = dir.VirtualAddress, dir.Size
+	}
+
+	return mem, nil
+}
+
+// peLayout normalizes the handful of OptionalHeader32/OptionalHeader64
+// fields the memory loader needs, so the rest of the loader doesn't have to
+// type-switch repeatedly.
+type peLayout struct {
+	imageBase     uint64
+	sizeOfImage   uint32
+	sizeOfHeaders uint32
+	entryPointRVA uint32
+	is64          bool
+	dataDirs      []pe.DataDirectory
+}
+
+func peLayoutFrom(f *pe.File) (*peLayout, error) {
+	switch opt := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader64:
+		return &peLayout{
+			imageBase:     opt.ImageBase,
+			sizeOfImage:   opt.SizeOfImage,
+			sizeOfHeaders: opt.SizeOfHeaders,
+			entryPointRVA: opt.AddressOfEntryPoint,
+			is64:          true,
+			dataDirs:      opt.DataDirectory[:],
+		}, nil
+	case *pe.OptionalHeader32:
+		return &peLayout{
+			imageBase:     uint64(opt.ImageBase),
+			sizeOfImage:   opt.SizeOfImage,
+			sizeOfHeaders: opt.SizeOfHeaders,
+			entryPointRVA: opt.AddressOfEntryPoint,
+			is64:          false,
+			dataDirs:      opt.DataDirectory[:],
+		}, nil
+	default:
+		return nil, fmt.Errorf("tempdll: unrecognized PE optional header")
+	}
+}
+
+func applyRelocations(image []byte, layout *peLayout) error {
+	if len(layout.dataDirs) <= imageDirectoryEntryBaseReloc {
+		return nil
+	}
+	dir := layout.dataDirs[imageDirectoryEntryBaseReloc]
+	if dir.Size == 0 {
+		return nil
+	}
+	if uint64(dir.VirtualAddress)+uint64(dir.Size) > uint64(len(image)) {
+		return fmt.Errorf("tempdll: base relocation directory out of range")
+	}
+	delta := int64(uintptr(unsafe.Pointer(&image[0]))) - int64(layout.imageBase)
+
+	reloc := image[dir.VirtualAddress : dir.VirtualAddress+dir.Size]
+	for len(reloc) >= 8 {
+		pageRVA := binary.LittleEndian.Uint32(reloc[0:4])
+		blockSize := binary.LittleEndian.Uint32(reloc[4:8])
+		if blockSize < 8 || int(blockSize) > len(reloc) {
+			break
+		}
+		entries := reloc[8:blockSize]
+		for len(entries) >= 2 {
+			entry := binary.LittleEndian.Uint16(entries[0:2])
+			entries = entries[2:]
+			typ := entry >> 12
+			off := uint32(entry & 0xfff)
+			target := pageRVA + off
+			if target+8 > uint32(len(image)) {
+				continue
+			}
+			switch typ {
+			case imageRelBasedAbsolute:
+				// padding entry, nothing to do
+			case imageRelBasedHighLow:
+				v := binary.LittleEndian.Uint32(image[target : target+4])
+				binary.LittleEndian.PutUint32(image[target:target+4], uint32(int64(v)+delta))
+			case imageRelBasedDir64:
+				v := binary.LittleEndian.Uint64(image[target : target+8])
+				binary.LittleEndian.PutUint64(image[target:target+8], uint64(int64(v)+delta))
+			}
+		}
+		reloc = reloc[blockSize:]
+	}
+	return nil
+}
+
+func resolveImports(image []byte, layout *peLayout) error {
+	if len(layout.dataDirs) <= imageDirectoryEntryImport {
+		return nil
+	}
+	dir := layout.dataDirs[imageDirectoryEntryImport]
+	if dir.Size == 0 {
+		return nil
+	}
+
+	const descSize = 20
+	thunkSize := uint32(4)
+	if layout.is64 {
+		thunkSize = 8
+	}
+
+	for off := dir.VirtualAddress; off+descSize <= uint32(len(image)); off += descSize {
+		originalFirstThunk := binary.LittleEndian.Uint32(image[off : off+4])
+		nameRVA := binary.LittleEndian.Uint32(image[off+12 : off+16])
+		firstThunk := binary.LittleEndian.Uint32(image[off+16 : off+20])
+		if originalFirstThunk == 0 && nameRVA == 0 && firstThunk == 0 {
+			break
+		}
+
+		moduleName := readCString(image, nameRVA)
+		hmod, err := windows.LoadLibrary(moduleName)
+		if err != nil {
+			return fmt.Errorf("tempdll: import %q: %w", moduleName, err)
+		}
+
+		lookupRVA := originalFirstThunk
+		if lookupRVA == 0 {
+			lookupRVA = firstThunk
+		}
+
+		for i := uint32(0); ; i++ {
+			thunkOff := lookupRVA + i*thunkSize
+			iatOff := firstThunk + i*thunkSize
+			if uint64(thunkOff)+uint64(thunkSize) > uint64(len(image)) {
+				break
+			}
+			if uint64(iatOff)+uint64(thunkSize) > uint64(len(image)) {
+				return fmt.Errorf("tempdll: %s: import address table entry out of range", moduleName)
+			}
+
+			var thunkVal uint64
+			if layout.is64 {
+				thunkVal = binary.LittleEndian.Uint64(image[thunkOff : thunkOff+8])
+			} else {
+				thunkVal = uint64(binary.LittleEndian.Uint32(image[thunkOff : thunkOff+4]))
+			}
+			if thunkVal == 0 {
+				break
+			}
+
+			var procAddr uintptr
+			ordinalFlag := imageOrdinalFlag32
+			if layout.is64 {
+				ordinalFlag = imageOrdinalFlag64
+			}
+			if thunkVal&ordinalFlag != 0 {
+				ordinal := uint16(thunkVal & 0xffff)
+				r1, _, callErr := kernel32GetProcAddress.Call(uintptr(hmod), uintptr(ordinal))
+				if r1 == 0 {
+					return fmt.Errorf("tempdll: %s: ordinal #%d: %w", moduleName, ordinal, callErr)
+				}
+				procAddr = r1
+			} else {
+				funcName := readCString(image, uint32(thunkVal)+2) // skip the Hint field
+				procAddr, err = windows.GetProcAddress(hmod, funcName)
+				if err != nil {
+					return fmt.Errorf("tempdll: %s: %s: %w", moduleName, funcName, err)
+				}
+			}
+
+			if layout.is64 {
+				binary.LittleEndian.PutUint64(image[iatOff:iatOff+8], uint64(procAddr))
+			} else {
+				binary.LittleEndian.PutUint32(image[iatOff:iatOff+4], uint32(procAddr))
+			}
+		}
+	}
+	return nil
+}
+
+func protectSections(base uintptr, f *pe.File, layout *peLayout) {
+	const (
+		scnMemExecute = 0x20000000
+		scnMemRead    = 0x40000000
+		scnMemWrite   = 0x80000000
+	)
+	for _, sec := range f.Sections {
+		if sec.VirtualSize == 0 {
+			continue
+		}
+		exec := sec.Characteristics&scnMemExecute != 0
+		read := sec.Characteristics&scnMemRead != 0
+		write := sec.Characteristics&scnMemWrite != 0
+
+		var protect uint32
+		switch {
+		case exec && write:
+			protect = windows.PAGE_EXECUTE_READWRITE
+		case exec && read:
+			protect = windows.PAGE_EXECUTE_READ
+		case exec:
+			protect = windows.PAGE_EXECUTE
+		case write:
+			protect = windows.PAGE_READWRITE
+		default:
+			protect = windows.PAGE_READONLY
+		}
+
+		var old uint32
+		size := sec.VirtualSize
+		if size > layout.sizeOfImage-sec.VirtualAddress {
+			size = layout.sizeOfImage - sec.VirtualAddress
+		}
+		windows.VirtualProtect(base+uintptr(sec.VirtualAddress), uintptr(size), protect, &old)
+	}
+}
+
+func runTLSCallbacks(image []byte, base uintptr, layout *peLayout) {
+	if len(layout.dataDirs) <= imageDirectoryEntryTLS {
+		return
+	}
+	dir := layout.dataDirs[imageDirectoryEntryTLS]
+	if dir.Size == 0 {
+		return
+	}
+
+	var callbacksAddr uint64
+	if layout.is64 {
+		// IMAGE_TLS_DIRECTORY64.AddressOfCallBacks is the 4th field, offset 24.
+		if dir.VirtualAddress+32 > uint32(len(image)) {
+			return
+		}
+		callbacksAddr = binary.LittleEndian.Uint64(image[dir.VirtualAddress+24 : dir.VirtualAddress+32])
+	} else {
+		// IMAGE_TLS_DIRECTORY32.AddressOfCallBacks is the 4th field, offset 12.
+		if dir.VirtualAddress+16 > uint32(len(image)) {
+			return
+		}
+		callbacksAddr = uint64(binary.LittleEndian.Uint32(image[dir.VirtualAddress+12 : dir.VirtualAddress+16]))
+	}
+	if callbacksAddr == 0 {
+		return
+	}
+
+	ptrSize := uintptr(4)
+	if layout.is64 {
+		ptrSize = 8
+	}
+	for i := uintptr(0); ; i++ {
+		addr := uintptr(callbacksAddr) + i*ptrSize
+		var cb uintptr
+		// addr walks the null-terminated TLS callback array at an address
+		// the TLS directory gives as an already-relocated absolute VA inside
+		// the image VirtualAlloc'd in mapPEImage, not an offset into the
+		// image []byte itself, so it cannot be bounds-checked against
+		// len(image); go vet flags this unsafe.Pointer conversion regardless.
+		if layout.is64 {
+			cb = uintptr(*(*uint64)(unsafe.Pointer(addr)))
+		} else {
+			cb = uintptr(*(*uint32)(unsafe.Pointer(addr)))
+		}
+		if cb == 0 {
+			break
+		}
+		callAddr(cb, base, dllProcessAttach, 0)
+	}
+}
+
+// findExport resolves name to an address by walking the export directory
+// table, following a single level of forwarded exports by falling back to
+// LoadLibrary/GetProcAddress for the forward target.
+func (mem *peImage) findExport(name string) (uintptr, error) {
+	if mem.exportSize == 0 {
+		return 0, fmt.Errorf("tempdll: %s: no export directory", name)
+	}
+	image := mem.image
+	off := mem.exportRVA
+	if off+40 > uint32(len(image)) {
+		return 0, fmt.Errorf("tempdll: %s: export directory out of range", name)
+	}
+
+	var dir imageExportDirectory
+	dir.NumberOfNames = binary.LittleEndian.Uint32(image[off+24 : off+28])
+	dir.AddressOfFunctions = binary.LittleEndian.Uint32(image[off+28 : off+32])
+	dir.AddressOfNames = binary.LittleEndian.Uint32(image[off+32 : off+36])
+	dir.AddressOfNameOrdinals = binary.LittleEndian.Uint32(image[off+36 : off+40])
+
+	for i := uint32(0); i < dir.NumberOfNames; i++ {
+		nameOff := dir.AddressOfNames + i*4
+		if uint64(nameOff)+4 > uint64(len(image)) {
+			return 0, fmt.Errorf("tempdll: %s: name table entry out of range", name)
+		}
+		nameRVA := binary.LittleEndian.Uint32(image[nameOff : nameOff+4])
+		if readCString(image, nameRVA) != name {
+			continue
+		}
+		ordinalOff := dir.AddressOfNameOrdinals + i*2
+		if uint64(ordinalOff)+2 > uint64(len(image)) {
+			return 0, fmt.Errorf("tempdll: %s: name ordinal table entry out of range", name)
+		}
+		ordinal := binary.LittleEndian.Uint16(image[ordinalOff : ordinalOff+2])
+		funcOff := dir.AddressOfFunctions + uint32(ordinal)*4
+		if uint64(funcOff)+4 > uint64(len(image)) {
+			return 0, fmt.Errorf("tempdll: %s: export address table entry out of range", name)
+		}
+		funcRVA := binary.LittleEndian.Uint32(image[funcOff : funcOff+4])
+
+		if funcRVA >= mem.exportRVA && funcRVA < mem.exportRVA+mem.exportSize {
+			forward := readCString(image, funcRVA)
+			parts := strings.SplitN(forward, ".", 2)
+			if len(parts) != 2 {
+				return 0, fmt.Errorf("tempdll: %s: malformed forwarder %q", name, forward)
+			}
+			modName := parts[0]
+			if !strings.ContainsRune(modName, '.') {
+				modName += ".dll"
+			}
+			hmod, err := windows.LoadLibrary(modName)
+			if err != nil {
+				return 0, fmt.Errorf("tempdll: %s: forwarded to %s: %w", name, forward, err)
+			}
+			addr, err := windows.GetProcAddress(hmod, parts[1])
+			if err != nil {
+				return 0, fmt.Errorf("tempdll: %s: forwarded to %s: %w", name, forward, err)
+			}
+			return addr, nil
+		}
+
+		return mem.base + uintptr(funcRVA), nil
+	}
+
+	return 0, fmt.Errorf("tempdll: %s: export not found", name)
+}
+
+func readCString(data []byte, offset uint32) string {
+	if int(offset) >= len(data) {
+		return ""
+	}
+	end := bytes.IndexByte(data[offset:], 0)
+	if end < 0 {
+		end = len(data) - int(offset)
+	}
+	return string(data[offset : offset+uint32(end)])
+}
@@ -0,0 +1,309 @@
+//go:build !windows && (linux || darwin || solaris)
+
+package tempdll
+
+/*
+#include <dlfcn.h>
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef uintptr_t (*tempdll_fn0)();
+typedef uintptr_t (*tempdll_fn1)(uintptr_t);
+typedef uintptr_t (*tempdll_fn2)(uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn3)(uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn4)(uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn5)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn6)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn7)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn8)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn9)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn10)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn11)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn12)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn13)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn14)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+typedef uintptr_t (*tempdll_fn15)(uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t, uintptr_t);
+
+// tempdll_call invokes fn, reinterpreted as a function taking n uintptr_t
+// arguments, with the first n entries of a. It mirrors the dispatch-by-arity
+// trick syscall.Syscall uses on Windows, since C has no portable way to call
+// through a function pointer of unknown arity.
+static uintptr_t tempdll_call(void *fn, uintptr_t *a, int n) {
+	switch (n) {
+	case 0:
+		return ((tempdll_fn0)fn)();
+	case 1:
+		return ((tempdll_fn1)fn)(a[0]);
+	case 2:
+		return ((tempdll_fn2)fn)(a[0], a[1]);
+	case 3:
+		return ((tempdll_fn3)fn)(a[0], a[1], a[2]);
+	case 4:
+		return ((tempdll_fn4)fn)(a[0], a[1], a[2], a[3]);
+	case 5:
+		return ((tempdll_fn5)fn)(a[0], a[1], a[2], a[3], a[4]);
+	case 6:
+		return ((tempdll_fn6)fn)(a[0], a[1], a[2], a[3], a[4], a[5]);
+	case 7:
+		return ((tempdll_fn7)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6]);
+	case 8:
+		return ((tempdll_fn8)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7]);
+	case 9:
+		return ((tempdll_fn9)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8]);
+	case 10:
+		return ((tempdll_fn10)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8], a[9]);
+	case 11:
+		return ((tempdll_fn11)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8], a[9], a[10]);
+	case 12:
+		return ((tempdll_fn12)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8], a[9], a[10], a[11]);
+	case 13:
+		return ((tempdll_fn13)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8], a[9], a[10], a[11], a[12]);
+	case 14:
+		return ((tempdll_fn14)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8], a[9], a[10], a[11], a[12], a[13]);
+	default:
+		return ((tempdll_fn15)fn)(a[0], a[1], a[2], a[3], a[4], a[5], a[6], a[7], a[8], a[9], a[10], a[11], a[12], a[13], a[14]);
+	}
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// A LazyDLL implements access to a single shared library loaded via dlopen.
+// It will delay the load of the library until the first call to its Handle
+// method or to one of its LazyProc's Addr method.
+type LazyDLL struct {
+	mu   sync.Mutex
+	dll  unsafe.Pointer // non nil once the library is loaded (a dlopen handle)
+	Name string
+
+	wroteDll  bool
+	dllHandle *os.File // a readonly fileHandle to block writes
+	fileName  string   // the full path to the temp file that is created
+	dllData   io.Reader
+	dllBytes  []byte // contents of dllData, read once and reused across Release/Load cycles
+
+	// generation is bumped by Release so that LazyProcs resolved before it
+	// know to re-resolve against the reloaded library instead of reusing a
+	// now-closed dlsym address.
+	generation uint32
+}
+
+// Load loads the library file d.Name into memory via dlopen. It returns an
+// error if it fails. Load will not try to load the library again if it is
+// already loaded into memory.
+func (d *LazyDLL) Load() error {
+	if atomic.LoadPointer(&d.dll) == nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.dll == nil {
+			if !d.wroteDll {
+				if d.dllBytes == nil {
+					contents := bytes.NewBuffer(nil)
+					if _, e := io.Copy(contents, d.dllData); e != nil {
+						return e
+					}
+					d.dllBytes = contents.Bytes()
+				}
+
+				sha := sha256.Sum256(d.dllBytes)
+				shaFileName := fileNameSafeEncoder.EncodeToString(sha[:])
+				d.fileName = filepath.Join(os.TempDir(), (shaFileName + "-" + d.Name))
+
+				handle, e := acquireFile(d.fileName, d.dllBytes, 60, time.Second)
+				if e != nil {
+					return e
+				}
+				d.dllHandle = handle
+
+				d.wroteDll = true
+			}
+
+			cFileName := C.CString(d.fileName)
+			defer C.free(unsafe.Pointer(cFileName))
+
+			handle := C.dlopen(cFileName, C.RTLD_NOW)
+			if handle == nil {
+				dlErr := errors.New(C.GoString(C.dlerror()))
+				return &DLLError{
+					Err:     dlErr,
+					ObjName: d.Name,
+					Msg:     fmt.Sprintf("tempdll: %s: dlopen failed: %v", d.Name, dlErr),
+				}
+			}
+
+			// dlopen's open fd/mapping keeps the inode alive, so the path can
+			// be unlinked right away: no explicit Release call is required to
+			// clean up the temp file, matching the automatic-cleanup behavior
+			// FILE_FLAG_DELETE_ON_CLOSE gives on Windows. A later LazyDLL
+			// loading identical content will find the path gone and
+			// acquireFile will transparently rewrite it.
+			os.Remove(d.fileName)
+
+			atomic.StorePointer(&d.dll, handle)
+		}
+	}
+	return nil
+}
+
+// mustLoad is like Load but panics if loading fails.
+func (d *LazyDLL) mustLoad() {
+	e := d.Load()
+	if e != nil {
+		panic(e)
+	}
+}
+
+// Handle returns d's dlopen handle.
+func (d *LazyDLL) Handle() uintptr {
+	d.mustLoad()
+	return uintptr(d.dll)
+}
+
+// Release unloads d, if loaded, by calling dlclose on its handle and
+// dropping its reference on the backing temp file. The backing file is
+// typically already gone from disk by this point, since Load unlinks it
+// right after a successful dlopen; releaseFile's removal then just reclaims
+// the reference-counting bookkeeping. After Release returns, d may be
+// loaded again with Load,
+// which re-acquires the temp file (from the cached bytes read on the first
+// Load, not by re-reading dllData) and calls dlopen again; LazyProcs
+// resolved before the Release re-resolve themselves against the reload
+// instead of reusing their now-invalid address.
+func (d *LazyDLL) Release() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.dll == nil {
+		return nil
+	}
+
+	var closeErr error
+	if C.dlclose(d.dll) != 0 {
+		dlErr := errors.New(C.GoString(C.dlerror()))
+		closeErr = &DLLError{
+			Err:     dlErr,
+			ObjName: d.Name,
+			Msg:     fmt.Sprintf("tempdll: %s: dlclose failed: %v", d.Name, dlErr),
+		}
+	}
+	releaseErr := releaseFile(d.fileName)
+
+	atomic.StorePointer(&d.dll, nil)
+	d.dllHandle = nil
+	d.wroteDll = false
+	atomic.AddUint32(&d.generation, 1)
+
+	if closeErr != nil {
+		return closeErr
+	}
+	return releaseErr
+}
+
+// NewLazyDLL creates a new LazyDLL associated with a shared library file.
+func NewLazyDLL(dll io.Reader, name string) *LazyDLL {
+	return &LazyDLL{Name: name, dllData: dll}
+}
+
+// A LazyProc implements access to a symbol inside a LazyDLL.
+// It delays the lookup until the Addr, Call, or Find method is called.
+type LazyProc struct {
+	mu   sync.Mutex
+	Name string
+	l    *LazyDLL
+	proc unsafe.Pointer // non nil once the symbol is found (a dlsym result)
+
+	gen uint32 // the l.generation this resolution was made against
+}
+
+// NewProc returns a LazyProc for accessing the named symbol in the library d.
+func (d *LazyDLL) NewProc(name string) *LazyProc {
+	return &LazyProc{l: d, Name: name}
+}
+
+// Find searches the library for the symbol named p.Name via dlsym. It
+// returns an error if the search fails. Find will not search again if the
+// symbol is already found, unless l has since been Released and reloaded,
+// in which case p re-resolves against the reload.
+func (p *LazyProc) Find() error {
+	curGen := atomic.LoadUint32(&p.l.generation)
+	if atomic.LoadPointer(&p.proc) == nil || atomic.LoadUint32(&p.gen) != curGen {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.proc == nil || p.gen != curGen {
+			e := p.l.Load()
+			if e != nil {
+				return e
+			}
+
+			cName := C.CString(p.Name)
+			defer C.free(unsafe.Pointer(cName))
+
+			C.dlerror() // clear any existing error
+			sym := C.dlsym(p.l.dll, cName)
+			if sym == nil {
+				if errStr := C.dlerror(); errStr != nil {
+					dlErr := errors.New(C.GoString(errStr))
+					return &DLLError{
+						Err:     dlErr,
+						ObjName: p.Name,
+						Msg:     fmt.Sprintf("tempdll: %s: dlsym failed: %v", p.Name, dlErr),
+					}
+				}
+			}
+			atomic.StorePointer(&p.proc, sym)
+			atomic.StoreUint32(&p.gen, curGen)
+		}
+	}
+	return nil
+}
+
+// mustFind is like Find but panics if the search fails.
+func (p *LazyProc) mustFind() {
+	e := p.Find()
+	if e != nil {
+		panic(e)
+	}
+}
+
+// Addr returns the address of the symbol represented by p.
+func (p *LazyProc) Addr() uintptr {
+	p.mustFind()
+	return uintptr(p.proc)
+}
+
+// Call executes the function p with arguments a, at most 15 of them,
+// matching the historical cap of syscall.Proc.Call. lastErr is always nil;
+// unlike Windows, POSIX errno is not reliably associated with a C call made
+// this way, so callers that need it should have the target function report
+// failure through its own return value.
+func (p *LazyProc) Call(a ...uintptr) (r1, r2 uintptr, lastErr error) {
+	p.mustFind()
+	if len(a) > 15 {
+		panic("tempdll: too many arguments to Call")
+	}
+
+	var cArgs [15]C.uintptr_t
+	for i, v := range a {
+		cArgs[i] = C.uintptr_t(v)
+	}
+	var argPtr *C.uintptr_t
+	if len(a) > 0 {
+		argPtr = &cArgs[0]
+	}
+
+	ret := C.tempdll_call(p.proc, argPtr, C.int(len(a)))
+	return uintptr(ret), 0, nil
+}